@@ -0,0 +1,471 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-06-01/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/azure/cli"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+
+	"github.com/cilium/cilium/pkg/azure/types"
+)
+
+// autoDiscoverTag is the VMSS tag Cilium looks for when the client was
+// created without any resource groups, i.e. when
+// AzureAutoDiscoverResourceGroups is enabled and no AzureResourceGroups were
+// configured explicitly.
+const autoDiscoverTag = "cilium-managed"
+
+// metadataURL is the well-known Azure instance metadata service endpoint.
+// It is only reachable from within an Azure VM.
+const metadataURL = "http://169.254.169.254/metadata"
+
+// AuthMethod selects how the ARM client obtains its credentials
+type AuthMethod string
+
+const (
+	// AuthMethodSPN authenticates using a Service Principal via the
+	// AZURE_CLIENT_ID / AZURE_CLIENT_SECRET / AZURE_TENANT_ID environment
+	// variables
+	AuthMethodSPN AuthMethod = "spn"
+
+	// AuthMethodMSI authenticates using the Managed Service Identity (IMS)
+	// assigned to the VM Cilium is running on. This is the default.
+	AuthMethodMSI AuthMethod = "msi"
+
+	// AuthMethodCLI authenticates by loading the token cached by a prior
+	// `az login`. This is primarily useful for local development and
+	// CloudShell.
+	AuthMethodCLI AuthMethod = "cli"
+)
+
+// MetricsAPI represents the metrics maintained by the Azure API client
+type MetricsAPI interface {
+	ObserveAPICall(call, status string, duration float64)
+	ObserveRateLimit(operation string, duration time.Duration)
+}
+
+// Client represents an Azure API client
+type Client struct {
+	interfacesClient network.InterfacesClient
+	vmssClient       compute.VirtualMachineScaleSetsClient
+
+	// resourceGroups holds the set of resource groups to discover VMSSes
+	// in. It is empty when resource groups are auto-discovered across
+	// the whole subscription.
+	resourceGroups []string
+
+	// usePerInterfaceResourceGroup routes AssignPrivateIpAddresses calls
+	// to the resource group extracted from the AzureInterface's ID rather
+	// than the (first) configured resource group. This is required for
+	// clusters that span multiple resource groups, e.g. AKS's MC_* node
+	// resource group. GetInterface and GetInterfaces are not affected by
+	// it; they always use the resource group passed by the caller.
+	usePerInterfaceResourceGroup bool
+
+	environment  azure.Environment
+	limiter      *rate.Limiter
+	limiterburst int
+	metricsAPI   MetricsAPI
+}
+
+// EnvironmentFromName resolves an Azure cloud name, e.g.
+// "AzurePublicCloud", "AzureUSGovernmentCloud", "AzureChinaCloud" or
+// "AzureGermanCloud", into its azure.Environment. An empty name resolves to
+// AzurePublicCloud.
+func EnvironmentFromName(name string) (azure.Environment, error) {
+	if name == "" {
+		return azure.PublicCloud, nil
+	}
+	return azure.EnvironmentFromName(name)
+}
+
+// NewAuthorizer constructs the autorest.Authorizer to use for ARM requests
+// according to authMethod. AuthMethodMSI is used when authMethod is empty.
+func NewAuthorizer(authMethod AuthMethod, env azure.Environment) (autorest.Authorizer, error) {
+	switch authMethod {
+	case AuthMethodSPN:
+		settings, err := auth.GetSettingsFromEnvironment()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read Service Principal credentials from environment")
+		}
+		settings.Environment = env
+		settings.Resource = env.ResourceManagerEndpoint
+		return settings.GetAuthorizer()
+	case AuthMethodCLI:
+		token, err := cli.GetTokenFromCLI(env.ResourceManagerEndpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load cached Azure CLI token")
+		}
+		adalToken, err := token.ToADALToken()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to convert Azure CLI token")
+		}
+		return autorest.NewBearerAuthorizer(&adalToken), nil
+	case AuthMethodMSI, "":
+		msiConfig := auth.NewMSIConfig()
+		msiConfig.Resource = env.ResourceManagerEndpoint
+		return msiConfig.Authorizer()
+	default:
+		return nil, fmt.Errorf("unknown Azure auth method %q", authMethod)
+	}
+}
+
+// NewClient returns a new Azure client. resourceGroupNames may contain more
+// than one resource group, e.g. when nodes are provisioned in a different
+// resource group than the cluster (AKS's MC_* node resource group being the
+// most common case). If resourceGroupNames is empty, VMSSes are
+// auto-discovered across the whole subscription by filtering on the
+// autoDiscoverTag. When usePerInterfaceResourceGroup is set,
+// AssignPrivateIpAddresses is routed to the resource group extracted from the
+// interface's own ID rather than one of resourceGroupNames; GetInterface and
+// GetInterfaces use the resource group their caller passes either way.
+func NewClient(subscriptionID string, resourceGroupNames []string, usePerInterfaceResourceGroup bool, env azure.Environment, authorizer autorest.Authorizer, metrics MetricsAPI, rateLimit float64, burst int) (*Client, error) {
+	interfacesClient := network.NewInterfacesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	interfacesClient.Authorizer = authorizer
+
+	vmssClient := compute.NewVirtualMachineScaleSetsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	vmssClient.Authorizer = authorizer
+
+	return &Client{
+		interfacesClient:             interfacesClient,
+		vmssClient:                   vmssClient,
+		resourceGroups:               resourceGroupNames,
+		usePerInterfaceResourceGroup: usePerInterfaceResourceGroup,
+		environment:                  env,
+		limiter:                      rate.NewLimiter(rate.Limit(rateLimit), burst),
+		limiterburst:                 burst,
+		metricsAPI:                   metrics,
+	}, nil
+}
+
+// GetVMSSResourceGroups returns the set of VMSS names mapped to the
+// resource group they live in. If the client was configured with explicit
+// resource groups, only those are searched; otherwise all VMSSes in the
+// subscription tagged with autoDiscoverTag are returned.
+func (c *Client) GetVMSSResourceGroups(ctx context.Context) (map[string]string, error) {
+	if len(c.resourceGroups) > 0 {
+		vmssToRG := map[string]string{}
+		for _, rg := range c.resourceGroups {
+			if err := c.waitForLimit(ctx, "ListVirtualMachineScaleSets"); err != nil {
+				return nil, err
+			}
+
+			sinceStart := time.Now()
+			result, err := c.vmssClient.List(ctx, rg)
+			c.observeAPICall("ListVirtualMachineScaleSets", err, time.Since(sinceStart))
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to list VMSSes in resource group %s", rg)
+			}
+
+			for result.NotDone() {
+				for _, vmss := range result.Values() {
+					if vmss.Name != nil {
+						vmssToRG[*vmss.Name] = rg
+					}
+				}
+				if err := result.NextWithContext(ctx); err != nil {
+					return nil, errors.Wrapf(err, "unable to page through VMSSes in resource group %s", rg)
+				}
+			}
+		}
+		return vmssToRG, nil
+	}
+
+	return c.discoverVMSSResourceGroups(ctx)
+}
+
+// discoverVMSSResourceGroups lists every VMSS in the subscription tagged
+// with autoDiscoverTag and returns a map of VMSS name to the resource group
+// it lives in, parsed out of the VMSS's own ID.
+func (c *Client) discoverVMSSResourceGroups(ctx context.Context) (map[string]string, error) {
+	if err := c.waitForLimit(ctx, "ListAllVirtualMachineScaleSets"); err != nil {
+		return nil, err
+	}
+
+	sinceStart := time.Now()
+	result, err := c.vmssClient.ListAll(ctx)
+	c.observeAPICall("ListAllVirtualMachineScaleSets", err, time.Since(sinceStart))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list VMSSes across subscription")
+	}
+
+	vmssToRG := map[string]string{}
+	for result.NotDone() {
+		for _, vmss := range result.Values() {
+			if vmss.Name == nil || vmss.ID == nil {
+				continue
+			}
+			if _, tagged := vmss.Tags[autoDiscoverTag]; !tagged {
+				continue
+			}
+
+			azureInterface := &types.AzureInterface{ID: *vmss.ID}
+			if rg := azureInterface.ResourceGroup(); rg != "" {
+				vmssToRG[*vmss.Name] = rg
+			}
+		}
+
+		if err := result.NextWithContext(ctx); err != nil {
+			return nil, errors.Wrap(err, "unable to page through VMSSes")
+		}
+	}
+
+	return vmssToRG, nil
+}
+
+// GetInterfaces returns all network interfaces attached to the VMSS
+// identified by vmssName in resourceGroup, keyed by VM name.
+func (c *Client) GetInterfaces(ctx context.Context, resourceGroup, vmssName string) (map[string]*types.AzureInterface, error) {
+	if err := c.waitForLimit(ctx, "ListVirtualMachineScaleSetNetworkInterfaces"); err != nil {
+		return nil, err
+	}
+
+	sinceStart := time.Now()
+	result, err := c.interfacesClient.ListVirtualMachineScaleSetNetworkInterfaces(ctx, resourceGroup, vmssName)
+	c.observeAPICall("ListVirtualMachineScaleSetNetworkInterfaces", err, time.Since(sinceStart))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list interfaces of VMSS %s", vmssName)
+	}
+
+	interfaces := map[string]*types.AzureInterface{}
+	for result.NotDone() {
+		for _, iface := range result.Values() {
+			azureInterface := parseInterface(&iface)
+			if azureInterface == nil {
+				continue
+			}
+			interfaces[azureInterface.VMName()] = azureInterface
+		}
+
+		if err := result.NextWithContext(ctx); err != nil {
+			return nil, errors.Wrap(err, "unable to page through VMSS interfaces")
+		}
+	}
+
+	return interfaces, nil
+}
+
+// GetInterface returns the network interface of a single VM within a VMSS
+// that lives in resourceGroup.
+func (c *Client) GetInterface(ctx context.Context, resourceGroup, vmssName, vmName string) (*types.AzureInterface, error) {
+	interfaces, err := c.GetInterfaces(ctx, resourceGroup, vmssName)
+	if err != nil {
+		return nil, err
+	}
+
+	iface, ok := interfaces[vmName]
+	if !ok {
+		return nil, fmt.Errorf("interface for VM %s not found in VMSS %s", vmName, vmssName)
+	}
+
+	return iface, nil
+}
+
+// AssignPrivateIpAddresses assigns additional private IP addresses to iface.
+// The resource group the update is sent to is picked according to
+// usePerInterfaceResourceGroup: either the resource group extracted from
+// iface's own ID (cross-resource-group deployments, e.g. AKS's MC_* node
+// resource group) or the client's first configured resource group.
+func (c *Client) AssignPrivateIpAddresses(ctx context.Context, iface *types.AzureInterface, addresses []string) error {
+	resourceGroup := c.defaultResourceGroup()
+	if c.usePerInterfaceResourceGroup {
+		if rg := iface.ResourceGroup(); rg != "" {
+			resourceGroup = rg
+		}
+	}
+
+	if err := c.waitForLimit(ctx, "GetInterface"); err != nil {
+		return err
+	}
+
+	sinceStart := time.Now()
+	current, err := c.interfacesClient.Get(ctx, resourceGroup, iface.Name, "")
+	c.observeAPICall("GetInterface", err, time.Since(sinceStart))
+	if err != nil {
+		return errors.Wrapf(err, "unable to retrieve interface %s in resource group %s", iface.Name, resourceGroup)
+	}
+
+	if current.IPConfigurations == nil || len(*current.IPConfigurations) == 0 {
+		return fmt.Errorf("interface %s has no IP configurations", iface.Name)
+	}
+
+	template := (*current.IPConfigurations)[0]
+	for _, address := range addresses {
+		ip := address
+		ipConfig := template
+		ipConfig.Name = &ip
+		ipConfig.InterfaceIPConfigurationPropertiesFormat = &network.InterfaceIPConfigurationPropertiesFormat{
+			PrivateIPAddress:          &ip,
+			PrivateIPAllocationMethod: network.Static,
+			Subnet:                    template.Subnet,
+		}
+		*current.IPConfigurations = append(*current.IPConfigurations, ipConfig)
+	}
+
+	sinceStart = time.Now()
+	future, err := c.interfacesClient.CreateOrUpdate(ctx, resourceGroup, iface.Name, current)
+	c.observeAPICall("UpdateInterface", err, time.Since(sinceStart))
+	if err != nil {
+		return errors.Wrapf(err, "unable to update interface %s in resource group %s", iface.Name, resourceGroup)
+	}
+
+	return future.WaitForCompletionRef(ctx, c.interfacesClient.Client)
+}
+
+// defaultResourceGroup returns the resource group to use when
+// usePerInterfaceResourceGroup is disabled or the interface's own resource
+// group cannot be determined.
+func (c *Client) defaultResourceGroup() string {
+	if len(c.resourceGroups) > 0 {
+		return c.resourceGroups[0]
+	}
+	return ""
+}
+
+// waitForLimit blocks until the client's rate limiter admits the next
+// request for operation, recording how long the caller had to wait
+func (c *Client) waitForLimit(ctx context.Context, operation string) error {
+	sinceStart := time.Now()
+	err := c.limiter.Wait(ctx)
+
+	if c.metricsAPI != nil {
+		c.metricsAPI.ObserveRateLimit(operation, time.Since(sinceStart))
+	}
+
+	return err
+}
+
+func (c *Client) observeAPICall(call string, err error, duration time.Duration) {
+	if c.metricsAPI == nil {
+		return
+	}
+
+	status := "OK"
+	if err != nil {
+		status = "Failed"
+	}
+
+	c.metricsAPI.ObserveAPICall(call, status, duration.Seconds())
+}
+
+func parseInterface(iface *network.Interface) *types.AzureInterface {
+	if iface == nil || iface.ID == nil {
+		return nil
+	}
+
+	azureInterface := &types.AzureInterface{
+		ID: *iface.ID,
+	}
+
+	if iface.Name != nil {
+		azureInterface.Name = *iface.Name
+	}
+
+	if iface.MacAddress != nil {
+		azureInterface.MAC = *iface.MacAddress
+	}
+
+	if iface.ProvisioningState != "" {
+		azureInterface.State = string(iface.ProvisioningState)
+	}
+
+	if iface.NetworkSecurityGroup != nil && iface.NetworkSecurityGroup.ID != nil {
+		azureInterface.SecurityGroup = *iface.NetworkSecurityGroup.ID
+	}
+
+	if iface.IPConfigurations != nil {
+		for _, ipConfig := range *iface.IPConfigurations {
+			if ipConfig.PrivateIPAddress == nil {
+				continue
+			}
+			azureInterface.Addresses = append(azureInterface.Addresses, types.AzureAddress{
+				IP:    *ipConfig.PrivateIPAddress,
+				State: types.StateSucceeded,
+			})
+		}
+	}
+
+	return azureInterface
+}
+
+// GetSubscriptionID retrieves the subscription ID via the Azure instance
+// metadata service. It is used when AzureSubscriptionID is not specified via
+// the CLI.
+func GetSubscriptionID(ctx context.Context) (string, error) {
+	compute, err := getComputeMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	return compute.SubscriptionID, nil
+}
+
+// GetResourceGroupName retrieves the resource group name via the Azure
+// instance metadata service. It is used when AzureResourceGroup is not
+// specified via the CLI.
+func GetResourceGroupName(ctx context.Context) (string, error) {
+	compute, err := getComputeMetadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	return compute.ResourceGroupName, nil
+}
+
+type computeMetadata struct {
+	SubscriptionID    string `json:"subscriptionId"`
+	ResourceGroupName string `json:"resourceGroupName"`
+}
+
+func getComputeMetadata(ctx context.Context) (*computeMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL+"/instance/compute?api-version=2019-04-30", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to reach Azure instance metadata service")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read Azure instance metadata response")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from Azure instance metadata service: %s", resp.StatusCode, string(body))
+	}
+
+	var compute computeMetadata
+	if err := json.Unmarshal(body, &compute); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal Azure instance metadata response")
+	}
+
+	return &compute, nil
+}
@@ -0,0 +1,339 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/azure/types"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "ipam-azure")
+
+const (
+	// baseTTL is the minimum amount of time a VMSS cache entry is
+	// considered fresh for
+	baseTTL = 5 * time.Minute
+
+	// jitter is the maximum amount of random jitter added on top of
+	// baseTTL when an InstancesManager picks its jitteredTTL
+	jitter = time.Minute
+
+	// baseRetryDelay is the initial back-off delay used when the Azure
+	// API returns a 429 (throttled) response
+	baseRetryDelay = time.Second
+
+	maxRetries = 5
+)
+
+// API is the subset of the Azure API required by the instances manager.
+// It is implemented by *api.Client.
+type API interface {
+	GetInterfaces(ctx context.Context, resourceGroup, vmssName string) (map[string]*types.AzureInterface, error)
+	GetVMSSResourceGroups(ctx context.Context) (map[string]string, error)
+}
+
+// instanceCache caches AzureInterface objects by VMSS name and VM name so
+// that Resync doesn't need to hit the (aggressively rate limited) ARM API
+// for VMSSes whose interfaces haven't changed.
+type instanceCache struct {
+	mutex sync.Mutex
+
+	// interfaces is indexed by VMSS name and then by VM name
+	interfaces map[string]map[string]*types.AzureInterface
+
+	// lastRefresh tracks, per VMSS name, the last time it was
+	// successfully refreshed from the ARM API
+	lastRefresh map[string]time.Time
+
+	// jitteredTTL is how long a VMSS cache entry remains valid for. It
+	// is randomized once, when the InstancesManager is created, and is
+	// shared by every entry of the cache.
+	jitteredTTL time.Duration
+
+	// vmssResourceGroups maps a VMSS name to the resource group it lives
+	// in. It is (re-)discovered every jitteredTTL, same as the interface
+	// cache itself.
+	vmssResourceGroups     map[string]string
+	vmssResourceGroupsSeen time.Time
+
+	metrics CacheMetrics
+}
+
+func newInstanceCache(metrics CacheMetrics) *instanceCache {
+	return &instanceCache{
+		interfaces:         map[string]map[string]*types.AzureInterface{},
+		lastRefresh:        map[string]time.Time{},
+		vmssResourceGroups: map[string]string{},
+		metrics:            metrics,
+	}
+}
+
+// isExpired returns true if the cached entry for vmssName must be refreshed
+func (c *instanceCache) isExpired(vmssName string, now time.Time) bool {
+	last, ok := c.lastRefresh[vmssName]
+	if !ok {
+		return true
+	}
+	return now.Sub(last) >= c.jitteredTTL
+}
+
+// InvalidateVMSS drops all cached interfaces of a VMSS, forcing the next
+// Resync to fetch it from the ARM API again.
+func (c *instanceCache) InvalidateVMSS(vmssName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.interfaces, vmssName)
+	delete(c.lastRefresh, vmssName)
+	c.metrics.ObserveCacheEvent("invalidation")
+}
+
+// InvalidateInstance drops the cached entry of a single VM, forcing the
+// VMSS it belongs to to be refreshed on the next Resync.
+func (c *instanceCache) InvalidateInstance(vmssName, vmName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if vms, ok := c.interfaces[vmssName]; ok {
+		delete(vms, vmName)
+	}
+	delete(c.lastRefresh, vmssName)
+	c.metrics.ObserveCacheEvent("invalidation")
+}
+
+// InstancesManager maintains the list of instances (VMSS virtual machines)
+// and their attached interfaces
+type InstancesManager struct {
+	api   API
+	cache *instanceCache
+}
+
+// NewInstancesManager returns a new azure InstancesManager
+func NewInstancesManager(api API, metrics CacheMetrics) *InstancesManager {
+	cache := newInstanceCache(metrics)
+	cache.jitteredTTL = baseTTL + time.Duration(rand.Int63n(int64(jitter)))
+
+	return &InstancesManager{
+		api:   api,
+		cache: cache,
+	}
+}
+
+// InvalidateVMSS invalidates the cached interfaces of vmssName, so that the
+// next GetInterface or Resync refreshes that VMSS instead of waiting out the
+// TTL. Nothing in the operator calls it on CiliumNode AzureStatus changes;
+// without an explicit call, a VMSS is only refreshed once its TTL expires.
+func (m *InstancesManager) InvalidateVMSS(vmssName string) {
+	m.cache.InvalidateVMSS(vmssName)
+}
+
+// InvalidateInstance invalidates the cached interface of a single VM
+func (m *InstancesManager) InvalidateInstance(vmssName, vmName string) {
+	m.cache.InvalidateInstance(vmssName, vmName)
+}
+
+// GetInterface returns the cached AzureInterface of the given VM, refreshing
+// its VMSS first if the cache entry has expired.
+func (m *InstancesManager) GetInterface(ctx context.Context, vmssName, vmName string) (*types.AzureInterface, error) {
+	m.cache.mutex.Lock()
+	expired := m.cache.isExpired(vmssName, time.Now())
+	m.cache.mutex.Unlock()
+
+	if expired {
+		if err := m.refreshVMSS(ctx, vmssName); err != nil {
+			return nil, err
+		}
+	} else {
+		m.cache.metrics.ObserveCacheEvent("hit")
+	}
+
+	m.cache.mutex.Lock()
+	defer m.cache.mutex.Unlock()
+
+	vms, ok := m.cache.interfaces[vmssName]
+	if !ok {
+		return nil, nil
+	}
+
+	return vms[vmName], nil
+}
+
+// ResolveAzureInterface implements lbpolicy.BackendMetadataResolver by
+// looking up the AzureInterface that owns ip among the currently cached
+// interfaces. It does not trigger a refresh: backend IPs are only
+// meaningful once their VMSS has been observed at least once, and Resync
+// already keeps the cache current.
+func (m *InstancesManager) ResolveAzureInterface(ip net.IP) (*types.AzureInterface, bool) {
+	m.cache.mutex.Lock()
+	defer m.cache.mutex.Unlock()
+
+	for _, vms := range m.cache.interfaces {
+		for _, iface := range vms {
+			for _, addr := range iface.Addresses {
+				if addr.IP == ip.String() {
+					return iface, true
+				}
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Resync refreshes all VMSSes whose cache entry has expired and returns the
+// time at which the resync was performed.
+func (m *InstancesManager) Resync(ctx context.Context) time.Time {
+	resyncStart := time.Now()
+
+	m.cache.mutex.Lock()
+	rgStale := time.Since(m.cache.vmssResourceGroupsSeen) >= m.cache.jitteredTTL
+	m.cache.mutex.Unlock()
+
+	if rgStale {
+		vmssToRG, err := m.api.GetVMSSResourceGroups(ctx)
+		if err != nil {
+			log.WithError(err).Warning("Unable to discover VMSS resource groups")
+		} else {
+			m.cache.mutex.Lock()
+			m.cache.vmssResourceGroups = vmssToRG
+			m.cache.vmssResourceGroupsSeen = resyncStart
+			m.cache.mutex.Unlock()
+		}
+	}
+
+	m.cache.mutex.Lock()
+	seen := map[string]struct{}{}
+	expired := make([]string, 0, len(m.cache.vmssResourceGroups))
+	for vmssName := range m.cache.vmssResourceGroups {
+		seen[vmssName] = struct{}{}
+		if m.cache.isExpired(vmssName, resyncStart) {
+			expired = append(expired, vmssName)
+		}
+	}
+	for vmssName := range m.cache.interfaces {
+		if _, ok := seen[vmssName]; ok {
+			continue
+		}
+		if m.cache.isExpired(vmssName, resyncStart) {
+			expired = append(expired, vmssName)
+		}
+	}
+	m.cache.mutex.Unlock()
+
+	for _, vmssName := range expired {
+		if err := m.refreshVMSS(ctx, vmssName); err != nil {
+			log.WithError(err).WithField("vmss", vmssName).Warning("Unable to refresh VMSS interfaces")
+		}
+	}
+
+	return resyncStart
+}
+
+// resourceGroupOf returns the resource group vmssName lives in, refreshing
+// the VMSS discovery map from the ARM API if it has no entry for vmssName or
+// has gone stale.
+func (m *InstancesManager) resourceGroupOf(ctx context.Context, vmssName string) (string, error) {
+	m.cache.mutex.Lock()
+	stale := time.Since(m.cache.vmssResourceGroupsSeen) >= m.cache.jitteredTTL
+	rg, ok := m.cache.vmssResourceGroups[vmssName]
+	m.cache.mutex.Unlock()
+
+	if ok && !stale {
+		return rg, nil
+	}
+
+	vmssToRG, err := m.api.GetVMSSResourceGroups(ctx)
+	if err != nil {
+		if ok {
+			// Serve the stale mapping rather than failing the refresh
+			// outright; it will be retried on the next Resync.
+			return rg, nil
+		}
+		return "", errors.Wrap(err, "unable to discover VMSS resource groups")
+	}
+
+	m.cache.mutex.Lock()
+	m.cache.vmssResourceGroups = vmssToRG
+	m.cache.vmssResourceGroupsSeen = time.Now()
+	rg = vmssToRG[vmssName]
+	m.cache.mutex.Unlock()
+
+	return rg, nil
+}
+
+// refreshVMSS fetches the interfaces of vmssName from the ARM API and
+// updates the cache, retrying with exponential back-off on throttling
+// (HTTP 429) responses.
+func (m *InstancesManager) refreshVMSS(ctx context.Context, vmssName string) error {
+	resourceGroup, err := m.resourceGroupOf(ctx, vmssName)
+	if err != nil {
+		return err
+	}
+
+	var interfaces map[string]*types.AzureInterface
+
+	delay := baseRetryDelay
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		interfaces, err = m.api.GetInterfaces(ctx, resourceGroup, vmssName)
+		if err == nil {
+			break
+		}
+
+		if !isThrottled(err) {
+			return errors.Wrapf(err, "unable to list interfaces of VMSS %s", vmssName)
+		}
+
+		log.WithError(err).WithField("vmss", vmssName).Debug("Azure API throttled, backing off")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to list interfaces of VMSS %s after %d retries", vmssName, maxRetries)
+	}
+
+	m.cache.mutex.Lock()
+	m.cache.interfaces[vmssName] = interfaces
+	m.cache.lastRefresh[vmssName] = time.Now()
+	m.cache.mutex.Unlock()
+
+	m.cache.metrics.ObserveCacheEvent("refresh")
+
+	return nil
+}
+
+// isThrottled returns true if err represents an HTTP 429 response from the
+// Azure ARM API
+func isThrottled(err error) bool {
+	if detailedErr, ok := err.(autorest.DetailedError); ok {
+		return detailedErr.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
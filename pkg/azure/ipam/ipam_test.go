@@ -0,0 +1,147 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !privileged_tests
+
+package ipam
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/pkg/azure/types"
+
+	"github.com/Azure/go-autorest/autorest"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+// fakeAPI implements API for tests. getInterfacesErrs is a queue of errors
+// returned by successive GetInterfaces calls before it starts returning
+// interfaces successfully. getInterfacesCall counts every GetInterfaces call.
+type fakeAPI struct {
+	getInterfacesErrs []error
+	getInterfacesCall int
+	interfaces        map[string]*types.AzureInterface
+	vmssToRG          map[string]string
+}
+
+func (f *fakeAPI) GetInterfaces(ctx context.Context, resourceGroup, vmssName string) (map[string]*types.AzureInterface, error) {
+	call := f.getInterfacesCall
+	f.getInterfacesCall++
+	if call < len(f.getInterfacesErrs) {
+		if err := f.getInterfacesErrs[call]; err != nil {
+			return nil, err
+		}
+	}
+	return f.interfaces, nil
+}
+
+func (f *fakeAPI) GetVMSSResourceGroups(ctx context.Context) (map[string]string, error) {
+	return f.vmssToRG, nil
+}
+
+// fakeCacheMetrics records every observed outcome for assertions
+type fakeCacheMetrics struct {
+	events []string
+}
+
+func (f *fakeCacheMetrics) ObserveCacheEvent(outcome string) {
+	f.events = append(f.events, outcome)
+}
+
+func throttledError() error {
+	return autorest.DetailedError{StatusCode: http.StatusTooManyRequests}
+}
+
+type IPAMTestSuite struct{}
+
+var _ = Suite(&IPAMTestSuite{})
+
+func (s *IPAMTestSuite) TestGetInterfaceCacheExpiryAndInvalidation(c *C) {
+	api := &fakeAPI{
+		interfaces: map[string]*types.AzureInterface{
+			"vm-1": {Name: "vm-1"},
+		},
+		vmssToRG: map[string]string{"vmss-1": "rg-1"},
+	}
+	metrics := &fakeCacheMetrics{}
+
+	m := NewInstancesManager(api, metrics)
+	m.cache.jitteredTTL = 10 * time.Millisecond
+
+	// First call: cache is empty, so it must refresh
+	iface, err := m.GetInterface(context.Background(), "vmss-1", "vm-1")
+	c.Assert(err, IsNil)
+	c.Assert(iface.Name, Equals, "vm-1")
+	c.Assert(metrics.events, DeepEquals, []string{"refresh"})
+
+	// Second call, within the TTL: served from cache, no refresh
+	metrics.events = nil
+	_, err = m.GetInterface(context.Background(), "vmss-1", "vm-1")
+	c.Assert(err, IsNil)
+	c.Assert(metrics.events, DeepEquals, []string{"hit"})
+
+	// Wait out the TTL: the entry is expired again, so it must refresh
+	time.Sleep(20 * time.Millisecond)
+	metrics.events = nil
+	_, err = m.GetInterface(context.Background(), "vmss-1", "vm-1")
+	c.Assert(err, IsNil)
+	c.Assert(metrics.events, DeepEquals, []string{"refresh"})
+
+	// Invalidating the VMSS forces the next call to refresh even though
+	// the TTL hasn't elapsed
+	metrics.events = nil
+	m.InvalidateVMSS("vmss-1")
+	_, err = m.GetInterface(context.Background(), "vmss-1", "vm-1")
+	c.Assert(err, IsNil)
+	c.Assert(metrics.events, DeepEquals, []string{"invalidation", "refresh"})
+}
+
+func (s *IPAMTestSuite) TestRefreshVMSSBacksOffOnThrottle(c *C) {
+	api := &fakeAPI{
+		getInterfacesErrs: []error{throttledError(), throttledError()},
+		interfaces: map[string]*types.AzureInterface{
+			"vm-1": {Name: "vm-1"},
+		},
+		vmssToRG: map[string]string{"vmss-1": "rg-1"},
+	}
+	m := NewInstancesManager(api, &fakeCacheMetrics{})
+
+	start := time.Now()
+	err := m.refreshVMSS(context.Background(), "vmss-1")
+	c.Assert(err, IsNil)
+	// baseRetryDelay (1s) + 2x that (2s) elapsed across the two throttled
+	// retries before the third attempt succeeded
+	c.Assert(time.Since(start) >= 3*time.Second, Equals, true)
+	c.Assert(api.getInterfacesCall, Equals, 3)
+}
+
+func (s *IPAMTestSuite) TestRefreshVMSSStopsOnContextCancellation(c *C) {
+	api := &fakeAPI{
+		getInterfacesErrs: []error{throttledError(), throttledError(), throttledError()},
+		vmssToRG:          map[string]string{"vmss-1": "rg-1"},
+	}
+	m := NewInstancesManager(api, &fakeCacheMetrics{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := m.refreshVMSS(ctx, "vmss-1")
+	c.Assert(err, Equals, context.Canceled)
+}
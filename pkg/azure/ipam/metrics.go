@@ -0,0 +1,66 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const labelOutcome = "outcome"
+
+// CacheMetrics is implemented by metrics backends that can observe instance
+// cache hits, refreshes and invalidations.
+type CacheMetrics interface {
+	// ObserveCacheEvent is called with "hit" when GetInterface is served
+	// from an unexpired cache entry, "refresh" when it has to fetch a
+	// VMSS from the ARM API, and "invalidation" when a targeted
+	// invalidation drops a cache entry early
+	ObserveCacheEvent(outcome string)
+}
+
+// prometheusMetrics implements CacheMetrics by exporting a Prometheus
+// CounterVec. The operator only ever constructs one of these, so it is
+// registered directly against the registry NewPrometheusMetrics is given
+// rather than via a package-level init().
+type prometheusMetrics struct {
+	cacheEvents *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics returns a CacheMetrics that registers its metrics
+// under namespace against registry.
+func NewPrometheusMetrics(namespace string, registry *prometheus.Registry) CacheMetrics {
+	m := &prometheusMetrics{
+		cacheEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "azure_instance_cache",
+			Name:      "events_total",
+			Help:      "Number of VMSS instance cache hits, refreshes and invalidations",
+		}, []string{labelOutcome}),
+	}
+
+	registry.MustRegister(m.cacheEvents)
+
+	return m
+}
+
+// ObserveCacheEvent implements CacheMetrics
+func (m *prometheusMetrics) ObserveCacheEvent(outcome string) {
+	m.cacheEvents.WithLabelValues(outcome).Inc()
+}
+
+// NoOpMetrics is a CacheMetrics that discards every observation. It is used
+// when EnableMetrics is disabled.
+type NoOpMetrics struct{}
+
+// ObserveCacheEvent implements CacheMetrics
+func (n *NoOpMetrics) ObserveCacheEvent(outcome string) {}
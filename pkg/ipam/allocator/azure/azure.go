@@ -24,26 +24,56 @@ import (
 	azureIPAM "github.com/cilium/cilium/pkg/azure/ipam"
 	"github.com/cilium/cilium/pkg/ipam"
 	ipamMetrics "github.com/cilium/cilium/pkg/ipam/metrics"
+	lbpolicy "github.com/cilium/cilium/pkg/loadbalancer/policy"
 	"github.com/cilium/cilium/pkg/logging"
 	"github.com/cilium/cilium/pkg/logging/logfields"
 	"github.com/cilium/cilium/pkg/option"
+	"github.com/cilium/cilium/pkg/service"
 	"github.com/pkg/errors"
 )
 
 var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "ipam-allocator-azure")
 
 // AllocatorAzure is an implementation of IPAM allocator interface for Azure
-type AllocatorAzure struct{}
+type AllocatorAzure struct {
+	// service is the load-balancing Service handler wired up against this
+	// allocator's InstancesManager, with the NSG-aware backend filter
+	// installed when AzureEnableNSGFilter is set. It is populated once
+	// Start has run.
+	service *service.Service
+
+	// nsgEvaluator is the evaluator backing the NSG-aware backend filter,
+	// populated whenever AzureEnableNSGFilter is set so that a future
+	// NSG-rule-sync watcher can reach it and call SetRules. It is nil
+	// when the filter is disabled.
+	nsgEvaluator *lbpolicy.StaticNSGEvaluator
+}
+
+// Service returns the Service handler constructed by Start, or nil if Start
+// has not been called yet.
+func (a *AllocatorAzure) Service() *service.Service {
+	return a.service
+}
+
+// NSGEvaluator returns the StaticNSGEvaluator backing the NSG-aware backend
+// filter, or nil if AzureEnableNSGFilter is disabled or Start has not been
+// called yet. It is the extension point a future NSG-rule-sync watcher
+// would call SetRules on.
+func (a *AllocatorAzure) NSGEvaluator() *lbpolicy.StaticNSGEvaluator {
+	return a.nsgEvaluator
+}
 
 // Init in Azure implementation doesn't need to do anything
 func (*AllocatorAzure) Init() error { return nil }
 
 // Start kicks of the Azure IP allocation
-func (*AllocatorAzure) Start(getterUpdater ipam.CiliumNodeGetterUpdater) (*ipam.NodeManager, error) {
+func (a *AllocatorAzure) Start(getterUpdater ipam.CiliumNodeGetterUpdater) (*ipam.NodeManager, error) {
 
 	var (
-		azMetrics azureAPI.MetricsAPI
-		iMetrics  ipam.MetricsAPI
+		azMetrics     azureAPI.MetricsAPI
+		iMetrics      ipam.MetricsAPI
+		cacheMetrics  azureIPAM.CacheMetrics
+		policyMetrics lbpolicy.Metrics
 	)
 
 	log.Info("Starting Azure IP allocator...")
@@ -59,35 +89,64 @@ func (*AllocatorAzure) Start(getterUpdater ipam.CiliumNodeGetterUpdater) (*ipam.
 		log.WithField("subscriptionID", subscriptionID).Debug("Detected subscriptionID via Azure IMS")
 	}
 
-	resourceGroupName := option.Config.AzureResourceGroup
-	if resourceGroupName == "" {
+	resourceGroupNames := option.Config.AzureResourceGroups
+	if len(resourceGroupNames) == 0 && option.Config.AzureResourceGroup != "" {
+		resourceGroupNames = []string{option.Config.AzureResourceGroup}
+	}
+	if len(resourceGroupNames) == 0 && option.Config.AzureAutoDiscoverResourceGroups {
+		log.Info("No resource group configured, auto-discovering Cilium-managed VMSSes across the whole subscription")
+	} else if len(resourceGroupNames) == 0 {
 		log.Debug("ResourceGroupName was not specified via CLI, retrieving it via Azure IMS")
 		rgName, err := azureAPI.GetResourceGroupName(context.TODO())
 		if err != nil {
 			return nil, errors.Wrap(err, "Azure resource group name was not specified via CLI and retrieving it from the Azure IMS was not possible")
 		}
-		resourceGroupName = rgName
-		log.WithField("resourceGroupName", resourceGroupName).Debug("Detected resource group name via Azure IMS")
+		resourceGroupNames = []string{rgName}
+		log.WithField("resourceGroupName", rgName).Debug("Detected resource group name via Azure IMS")
 	}
 
 	if option.Config.EnableMetrics {
 		azMetrics = apiMetrics.NewPrometheusMetrics(operatorMetrics.Namespace, "azure", operatorMetrics.Registry)
 		iMetrics = ipamMetrics.NewPrometheusMetrics(operatorMetrics.Namespace, operatorMetrics.Registry)
+		cacheMetrics = azureIPAM.NewPrometheusMetrics(operatorMetrics.Namespace, operatorMetrics.Registry)
+		policyMetrics = lbpolicy.NewPrometheusMetrics(operatorMetrics.Namespace, operatorMetrics.Registry)
 	} else {
 		azMetrics = &apiMetrics.NoOpMetrics{}
 		iMetrics = &ipamMetrics.NoOpMetrics{}
+		cacheMetrics = &azureIPAM.NoOpMetrics{}
+		policyMetrics = &lbpolicy.NoOpMetrics{}
+	}
+
+	env, err := azureAPI.EnvironmentFromName(option.Config.AzureCloudEnvironment)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to resolve Azure cloud environment")
+	}
+
+	authorizer, err := azureAPI.NewAuthorizer(azureAPI.AuthMethod(option.Config.AzureAuthMethod), env)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create Azure authorizer")
 	}
 
-	azureClient, err := azureAPI.NewClient(subscriptionID, resourceGroupName, azMetrics, option.Config.IPAMAPIQPSLimit, option.Config.IPAMAPIBurst)
+	azureClient, err := azureAPI.NewClient(subscriptionID, resourceGroupNames, option.Config.AzureUsePerInterfaceResourceGroup, env, authorizer, azMetrics, option.Config.IPAMAPIQPSLimit, option.Config.IPAMAPIBurst)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create Azure client: %w", err)
 	}
-	instances := azureIPAM.NewInstancesManager(azureClient)
+	instances := azureIPAM.NewInstancesManager(azureClient, cacheMetrics)
 	nodeManager, err := ipam.NewNodeManager(instances, getterUpdater, iMetrics, option.Config.ParallelAllocWorkers, false)
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize Azure node manager: %w", err)
 	}
 
+	if option.Config.AzureEnableNSGFilter {
+		// instances also resolves backend IPs to the AzureInterface that
+		// owns them, so it doubles as the NSG filter's
+		// BackendMetadataResolver.
+		a.nsgEvaluator = lbpolicy.NewStaticNSGEvaluator()
+		a.service = service.NewAzureService(instances, a.nsgEvaluator, policyMetrics)
+	} else {
+		a.service = service.NewService()
+	}
+
 	nodeManager.Start(context.TODO())
 
 	return nodeManager, nil
@@ -0,0 +1,100 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loadbalancer defines the addressing types shared by the service
+// manager and the BPF load-balancing maps.
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+)
+
+// L4Type is the type of L4 protocol a frontend or backend listens on
+type L4Type string
+
+const (
+	// TCP is the L4 TCP protocol
+	TCP L4Type = "TCP"
+	// UDP is the L4 UDP protocol
+	UDP L4Type = "UDP"
+)
+
+// ID is the identifier of a service as handed out by the local ID allocator
+type ID uint32
+
+// ServiceID is the service ID as used in the BPF maps
+type ServiceID uint16
+
+// BackendID is the backend ID as used in the BPF maps
+type BackendID uint32
+
+// L4Addr is a L4 address, i.e. a protocol and port pair
+type L4Addr struct {
+	Protocol L4Type
+	Port     uint16
+}
+
+// L3n4Addr represents a L3 (IP) + L4 (protocol/port) address
+type L3n4Addr struct {
+	IP net.IP
+	L4Addr
+}
+
+// String returns the string representation of an L3n4Addr
+func (a L3n4Addr) String() string {
+	return fmt.Sprintf("%s:%d/%s", a.IP, a.Port, a.Protocol)
+}
+
+// NewL3n4Addr creates a new L3n4Addr
+func NewL3n4Addr(protocol L4Type, ip net.IP, port uint16) *L3n4Addr {
+	return &L3n4Addr{
+		IP: ip,
+		L4Addr: L4Addr{
+			Protocol: protocol,
+			Port:     port,
+		},
+	}
+}
+
+// L3n4AddrID is a L3n4Addr with its allocated ID
+type L3n4AddrID struct {
+	L3n4Addr
+	ID ID
+}
+
+// NewL3n4AddrID creates a new L3n4AddrID. id may be 0 to indicate that no ID
+// has been allocated yet.
+func NewL3n4AddrID(protocol L4Type, ip net.IP, port uint16, id ID) *L3n4AddrID {
+	return &L3n4AddrID{
+		L3n4Addr: *NewL3n4Addr(protocol, ip, port),
+		ID:       id,
+	}
+}
+
+// LBBackEnd represents a single load-balancing backend
+type LBBackEnd struct {
+	L3n4Addr
+	ID     BackendID
+	Weight uint16
+}
+
+// NewLBBackEnd creates a new LBBackEnd
+func NewLBBackEnd(id BackendID, protocol L4Type, ip net.IP, port uint16) *LBBackEnd {
+	return &LBBackEnd{
+		L3n4Addr: *NewL3n4Addr(protocol, ip, port),
+		ID:       id,
+		Weight:   1,
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics is implemented by metrics backends that can observe backends
+// elided by the NSG-aware Filter.
+type Metrics interface {
+	// ObserveElidedBackend is called every time Filter.Apply elides a
+	// backend for the given L4 protocol
+	ObserveElidedBackend(protocol string)
+}
+
+// prometheusMetrics implements Metrics by exporting a Prometheus CounterVec.
+// The operator only ever constructs one of these, so it is registered
+// directly against the registry NewPrometheusMetrics is given rather than
+// via a package-level init().
+type prometheusMetrics struct {
+	elidedBackends *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics returns a Metrics that registers its metrics under
+// namespace against registry.
+func NewPrometheusMetrics(namespace string, registry *prometheus.Registry) Metrics {
+	m := &prometheusMetrics{
+		elidedBackends: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "loadbalancer_policy",
+			Name:      "elided_backends_total",
+			Help:      "Number of backends elided from a service because the owning Azure NSG denies the frontend port",
+		}, []string{"protocol"}),
+	}
+
+	registry.MustRegister(m.elidedBackends)
+
+	return m
+}
+
+// ObserveElidedBackend implements Metrics
+func (m *prometheusMetrics) ObserveElidedBackend(protocol string) {
+	m.elidedBackends.WithLabelValues(protocol).Inc()
+}
+
+// NoOpMetrics is a Metrics that discards every observation. It is used when
+// EnableMetrics is disabled.
+type NoOpMetrics struct{}
+
+// ObserveElidedBackend implements Metrics
+func (n *NoOpMetrics) ObserveElidedBackend(protocol string) {}
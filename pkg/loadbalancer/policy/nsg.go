@@ -0,0 +1,71 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	lb "github.com/cilium/cilium/pkg/loadbalancer"
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// Rule is a single (protocol, port) pair an NSG permits
+type Rule struct {
+	Protocol lb.L4Type
+	Port     uint16
+}
+
+// StaticNSGEvaluator is a concrete NSGEvaluator backed by an in-memory,
+// caller-populated allow-list of NSG rules. It is intended to be kept in
+// sync with the Azure NSGs referenced by AzureInterfaces, e.g. by an
+// operator-side NSG watcher calling SetRules whenever an NSG's security
+// rules change.
+type StaticNSGEvaluator struct {
+	mutex lock.RWMutex
+	rules map[string]map[Rule]struct{}
+}
+
+// NewStaticNSGEvaluator returns an empty StaticNSGEvaluator. With no rules
+// installed for an NSG, Allows denies all traffic through it, since an
+// Azure NSG with no matching rule falls back to its default deny.
+func NewStaticNSGEvaluator() *StaticNSGEvaluator {
+	return &StaticNSGEvaluator{
+		rules: map[string]map[Rule]struct{}{},
+	}
+}
+
+// SetRules replaces the set of rules nsgID permits
+func (e *StaticNSGEvaluator) SetRules(nsgID string, permitted []Rule) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	rules := make(map[Rule]struct{}, len(permitted))
+	for _, r := range permitted {
+		rules[r] = struct{}{}
+	}
+	e.rules[nsgID] = rules
+}
+
+// Allows implements NSGEvaluator
+func (e *StaticNSGEvaluator) Allows(nsgID string, protocol lb.L4Type, port uint16) bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	rules, ok := e.rules[nsgID]
+	if !ok {
+		return false
+	}
+
+	_, allowed := rules[Rule{Protocol: protocol, Port: port}]
+	return allowed
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy provides policy-consistent load-balancing: it lets the
+// service manager consult cloud-provider network policy (currently Azure
+// NSGs) before a backend is programmed into lbmap, so that Cilium services
+// and the underlying cloud firewall can't silently disagree about whether a
+// backend is reachable.
+package policy
+
+import (
+	"net"
+
+	azureTypes "github.com/cilium/cilium/pkg/azure/types"
+	lb "github.com/cilium/cilium/pkg/loadbalancer"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "loadbalancer-policy")
+
+// BackendMetadataResolver maps a backend IP to the AzureInterface that owns
+// it, e.g. by looking it up in the operator's CiliumNode/AzureInterface
+// cache.
+type BackendMetadataResolver interface {
+	ResolveAzureInterface(ip net.IP) (iface *azureTypes.AzureInterface, ok bool)
+}
+
+// NSGEvaluator decides whether an Azure Network Security Group permits
+// traffic on a given L4 port.
+type NSGEvaluator interface {
+	Allows(nsgID string, protocol lb.L4Type, port uint16) bool
+}
+
+// Filter elides backends whose owning AzureInterface carries an NSG that
+// denies traffic on the frontend's L4 port. A Filter with a nil Resolver or
+// Evaluator is a no-op, so services default to today's behavior unless NSG
+// awareness is explicitly wired in.
+type Filter struct {
+	Resolver  BackendMetadataResolver
+	Evaluator NSGEvaluator
+	Metrics   Metrics
+}
+
+// Apply splits backends into the ones whose owning AzureInterface's NSG
+// permits the frontend's protocol and port and the ones that must be elided
+// from lbmap. Backends that cannot be resolved, or whose interface carries
+// no NSG, are allowed.
+func (f *Filter) Apply(frontend lb.L3n4Addr, backends []lb.LBBackEnd) (allowed, denied []lb.LBBackEnd) {
+	if f == nil || f.Resolver == nil || f.Evaluator == nil {
+		return backends, nil
+	}
+
+	for _, backend := range backends {
+		iface, ok := f.Resolver.ResolveAzureInterface(backend.IP)
+		if !ok || iface.SecurityGroup == "" {
+			allowed = append(allowed, backend)
+			continue
+		}
+
+		if f.Evaluator.Allows(iface.SecurityGroup, frontend.Protocol, frontend.Port) {
+			allowed = append(allowed, backend)
+		} else {
+			log.WithField("backend", backend.IP.String()).
+				WithField("securityGroup", iface.SecurityGroup).
+				WithField("port", frontend.Port).
+				Info("Eliding backend: denied by Azure NSG")
+			if f.Metrics != nil {
+				f.Metrics.ObserveElidedBackend(string(frontend.Protocol))
+			}
+			denied = append(denied, backend)
+		}
+	}
+
+	return allowed, denied
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lbmap
+
+import (
+	"fmt"
+
+	"github.com/cilium/cilium/pkg/bpf"
+	lb "github.com/cilium/cilium/pkg/loadbalancer"
+)
+
+const (
+	serviceMapName = "cilium_lb4_services_v2"
+	backendMapName = "cilium_lb4_backends"
+)
+
+// bpfLBMap is the production LBMap implementation, backed by the kernel BPF
+// maps the datapath reads from
+type bpfLBMap struct {
+	serviceMap *bpf.Map
+	backendMap *bpf.Map
+}
+
+func newBPFLBMap() *bpfLBMap {
+	return &bpfLBMap{
+		serviceMap: bpf.NewMap(serviceMapName, bpf.MapTypeHash),
+		backendMap: bpf.NewMap(backendMapName, bpf.MapTypeHash),
+	}
+}
+
+// UpsertService implements LBMap
+func (b *bpfLBMap) UpsertService(id lb.ID, frontend lb.L3n4Addr, backendIDs []lb.BackendID) error {
+	key := uint16(id)
+	value := struct {
+		Frontend   lb.L3n4Addr
+		BackendIDs []lb.BackendID
+	}{Frontend: frontend, BackendIDs: backendIDs}
+
+	if err := b.serviceMap.Update(key, value); err != nil {
+		return fmt.Errorf("unable to update service map for service %d: %w", id, err)
+	}
+
+	return nil
+}
+
+// DeleteService implements LBMap
+func (b *bpfLBMap) DeleteService(id lb.ID) error {
+	if err := b.serviceMap.Delete(uint16(id)); err != nil {
+		return fmt.Errorf("unable to delete service %d from service map: %w", id, err)
+	}
+
+	return nil
+}
+
+// AddBackend implements LBMap
+func (b *bpfLBMap) AddBackend(backend lb.LBBackEnd) error {
+	if err := b.backendMap.Update(uint16(backend.ID), backend); err != nil {
+		return fmt.Errorf("unable to update backend map for backend %d: %w", backend.ID, err)
+	}
+
+	return nil
+}
+
+// DeleteBackend implements LBMap
+func (b *bpfLBMap) DeleteBackend(id lb.BackendID) error {
+	if err := b.backendMap.Delete(uint16(id)); err != nil {
+		return fmt.Errorf("unable to delete backend %d from backend map: %w", id, err)
+	}
+
+	return nil
+}
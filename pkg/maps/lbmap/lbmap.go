@@ -0,0 +1,34 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lbmap
+
+import (
+	lb "github.com/cilium/cilium/pkg/loadbalancer"
+)
+
+// LBMap is the interface describing methods for manipulating service and
+// backend entries in the BPF load-balancing maps
+type LBMap interface {
+	UpsertService(id lb.ID, frontend lb.L3n4Addr, backendIDs []lb.BackendID) error
+	DeleteService(id lb.ID) error
+	AddBackend(backend lb.LBBackEnd) error
+	DeleteBackend(id lb.BackendID) error
+}
+
+// New opens (and creates if necessary) the BPF load-balancing maps backing
+// the real implementation of LBMap. Tests should use NewLBMockMap instead.
+func New() LBMap {
+	return newBPFLBMap()
+}
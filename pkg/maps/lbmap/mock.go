@@ -0,0 +1,87 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lbmap
+
+import (
+	lb "github.com/cilium/cilium/pkg/loadbalancer"
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// LBMockMap is a mock implementation of LBMap for use in unit tests. Its
+// fields are exported so that tests can assert on the exact state of the
+// "BPF" maps without going through the LBMap interface.
+type LBMockMap struct {
+	mutex lock.Mutex
+
+	// ServiceBackendsByID holds, for every service ID, the list of
+	// backend IDs currently programmed for it
+	ServiceBackendsByID map[uint16][]uint16
+
+	// BackendByID holds every backend currently programmed, keyed by its
+	// backend ID
+	BackendByID map[uint16]lb.LBBackEnd
+}
+
+// NewLBMockMap creates a new empty LBMockMap
+func NewLBMockMap() *LBMockMap {
+	return &LBMockMap{
+		ServiceBackendsByID: map[uint16][]uint16{},
+		BackendByID:         map[uint16]lb.LBBackEnd{},
+	}
+}
+
+// UpsertService implements LBMap
+func (m *LBMockMap) UpsertService(id lb.ID, frontend lb.L3n4Addr, backendIDs []lb.BackendID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ids := make([]uint16, 0, len(backendIDs))
+	for _, backendID := range backendIDs {
+		ids = append(ids, uint16(backendID))
+	}
+	m.ServiceBackendsByID[uint16(id)] = ids
+
+	return nil
+}
+
+// DeleteService implements LBMap
+func (m *LBMockMap) DeleteService(id lb.ID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.ServiceBackendsByID, uint16(id))
+
+	return nil
+}
+
+// AddBackend implements LBMap
+func (m *LBMockMap) AddBackend(backend lb.LBBackEnd) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.BackendByID[uint16(backend.ID)] = backend
+
+	return nil
+}
+
+// DeleteBackend implements LBMap
+func (m *LBMockMap) DeleteBackend(id lb.BackendID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.BackendByID, uint16(id))
+
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package option
+
+import (
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const (
+	// EnableMetrics enables the Prometheus metrics server
+	EnableMetrics = "enable-metrics"
+
+	// IPAMAPIQPSLimit is the queries per second limit for the IPAM (e.g.
+	// Azure ARM) API
+	IPAMAPIQPSLimit = "limit-ipam-api-qps"
+
+	// IPAMAPIBurst is the burst value allowed for the IPAM API
+	IPAMAPIBurst = "limit-ipam-api-burst"
+
+	// ParallelAllocWorkers is the number of workers used for parallel
+	// IPAM allocation
+	ParallelAllocWorkers = "parallel-alloc-workers"
+
+	// AzureSubscriptionID is the subscription ID to use when using Azure IPAM
+	AzureSubscriptionID = "azure-subscription-id"
+
+	// AzureResourceGroup is the resource group to use when using Azure IPAM
+	AzureResourceGroup = "azure-resource-group"
+
+	// AzureCloudEnvironment is the name of the Azure cloud environment to
+	// authenticate and make ARM requests against, e.g.
+	// AzureUSGovernmentCloud, AzureChinaCloud or AzureGermanCloud. Defaults
+	// to AzurePublicCloud.
+	AzureCloudEnvironment = "azure-cloud-environment"
+
+	// AzureAuthMethod selects how the Azure ARM client authenticates: "msi"
+	// (default), "spn" or "cli"
+	AzureAuthMethod = "azure-auth-method"
+
+	// AzureResourceGroups is the set of resource groups to discover Azure
+	// interfaces in. Takes precedence over the singular AzureResourceGroup
+	// when set, allowing allocation across more than one resource group.
+	AzureResourceGroups = "azure-resource-groups"
+
+	// AzureUsePerInterfaceResourceGroup makes interface updates (e.g.
+	// AssignPrivateIpAddresses) target the resource group extracted from
+	// each interface's own ID rather than the client's configured resource
+	// group, for deployments where interfaces live in a different resource
+	// group than the one allocation is configured against (e.g. AKS's
+	// MC_* node resource group).
+	AzureUsePerInterfaceResourceGroup = "azure-use-per-interface-resource-group"
+
+	// AzureAutoDiscoverResourceGroups skips the IMS single-resource-group
+	// fallback entirely, so that an unset AzureResourceGroups/
+	// AzureResourceGroup leaves the Azure client with no configured
+	// resource groups and it auto-discovers VMSSes tagged for Cilium
+	// across the whole subscription instead.
+	AzureAutoDiscoverResourceGroups = "azure-auto-discover-resource-groups"
+
+	// AzureEnableNSGFilter enables eliding service backends whose owning
+	// Azure NIC carries an NSG that denies the frontend's port. It
+	// defaults to off: the NSG rules fed into the evaluator today are
+	// never populated from a real ARM-backed rule source, so enabling
+	// this without one would elide every backend behind an NSG.
+	AzureEnableNSGFilter = "azure-enable-nsg-filter"
+)
+
+// OperatorConfig holds the configuration options of the operator's IPAM
+// allocators
+type OperatorConfig struct {
+	// EnableMetrics enables the Prometheus metrics server
+	EnableMetrics bool
+
+	// IPAMAPIQPSLimit is the queries per second limit for the IPAM API
+	IPAMAPIQPSLimit float64
+
+	// IPAMAPIBurst is the burst value allowed for the IPAM API
+	IPAMAPIBurst int
+
+	// ParallelAllocWorkers is the number of workers used for parallel
+	// IPAM allocation
+	ParallelAllocWorkers int64
+
+	// AzureSubscriptionID is the subscription ID to use when using Azure IPAM
+	AzureSubscriptionID string
+
+	// AzureResourceGroup is the resource group to use when using Azure IPAM
+	AzureResourceGroup string
+
+	// AzureCloudEnvironment is the name of the Azure cloud environment to
+	// authenticate and make ARM requests against
+	AzureCloudEnvironment string
+
+	// AzureAuthMethod selects how the Azure ARM client authenticates
+	AzureAuthMethod string
+
+	// AzureResourceGroups is the set of resource groups to discover Azure
+	// interfaces in. Takes precedence over AzureResourceGroup when set.
+	AzureResourceGroups []string
+
+	// AzureUsePerInterfaceResourceGroup makes interface updates target the
+	// resource group extracted from each interface's own ID rather than
+	// the client's configured resource group
+	AzureUsePerInterfaceResourceGroup bool
+
+	// AzureAutoDiscoverResourceGroups skips the IMS single-resource-group
+	// fallback so VMSSes are auto-discovered across the whole subscription
+	AzureAutoDiscoverResourceGroups bool
+
+	// AzureEnableNSGFilter enables eliding service backends denied by
+	// their owning Azure NIC's NSG. Off by default; see the flag's help
+	// text for why.
+	AzureEnableNSGFilter bool
+}
+
+// Config holds the active operator configuration
+var Config = &OperatorConfig{}
+
+// Flags registers the operator's IPAM allocator flags onto flags
+func Flags(flags *pflag.FlagSet) {
+	flags.Bool(EnableMetrics, false, "Enable Prometheus metrics")
+	flags.Float64(IPAMAPIQPSLimit, 20.0, "Queries per second limit for the IPAM API")
+	flags.Int(IPAMAPIBurst, 20, "Burst value allowed for the IPAM API")
+	flags.Int64(ParallelAllocWorkers, 50, "Maximum number of parallel IPAM allocation workers")
+
+	flags.String(AzureSubscriptionID, "", "Azure subscription ID to use when using Azure IPAM")
+	flags.String(AzureResourceGroup, "", "Azure resource group to use when using Azure IPAM")
+	flags.String(AzureCloudEnvironment, "", "Azure cloud environment to authenticate and make ARM requests against (defaults to AzurePublicCloud)")
+	flags.String(AzureAuthMethod, "msi", "Azure authentication method to use for ARM requests: msi, spn or cli")
+	flags.StringSlice(AzureResourceGroups, nil, "Azure resource groups to discover interfaces in when using Azure IPAM (takes precedence over azure-resource-group)")
+	flags.Bool(AzureUsePerInterfaceResourceGroup, false, "Use the resource group of each Azure interface, rather than the configured resource group(s), when updating that interface")
+	flags.Bool(AzureAutoDiscoverResourceGroups, false, "Auto-discover Cilium-managed VMSSes across the whole subscription instead of falling back to the resource group reported by the Azure IMS")
+	flags.Bool(AzureEnableNSGFilter, false, "Elide service backends whose owning Azure NIC carries an NSG that denies the frontend's port (requires a real NSG-rule-sync mechanism to populate rules; unsafe to enable until one exists)")
+}
+
+// Populate reads the bound flags from viper into Config
+func (c *OperatorConfig) Populate() {
+	c.EnableMetrics = viper.GetBool(EnableMetrics)
+	c.IPAMAPIQPSLimit = viper.GetFloat64(IPAMAPIQPSLimit)
+	c.IPAMAPIBurst = viper.GetInt(IPAMAPIBurst)
+	c.ParallelAllocWorkers = viper.GetInt64(ParallelAllocWorkers)
+
+	c.AzureSubscriptionID = viper.GetString(AzureSubscriptionID)
+	c.AzureResourceGroup = viper.GetString(AzureResourceGroup)
+	c.AzureCloudEnvironment = viper.GetString(AzureCloudEnvironment)
+	c.AzureAuthMethod = viper.GetString(AzureAuthMethod)
+	c.AzureResourceGroups = viper.GetStringSlice(AzureResourceGroups)
+	c.AzureUsePerInterfaceResourceGroup = viper.GetBool(AzureUsePerInterfaceResourceGroup)
+	c.AzureAutoDiscoverResourceGroups = viper.GetBool(AzureAutoDiscoverResourceGroups)
+	c.AzureEnableNSGFilter = viper.GetBool(AzureEnableNSGFilter)
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !privileged_tests
+
+package service
+
+import (
+	"net"
+
+	azureTypes "github.com/cilium/cilium/pkg/azure/types"
+	lb "github.com/cilium/cilium/pkg/loadbalancer"
+	lbpolicy "github.com/cilium/cilium/pkg/loadbalancer/policy"
+	"github.com/cilium/cilium/pkg/maps/lbmap"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeResolver resolves backend IPs to AzureInterfaces from a static map,
+// standing in for the azure ipam InstancesManager in tests
+type fakeResolver map[string]*azureTypes.AzureInterface
+
+func (f fakeResolver) ResolveAzureInterface(ip net.IP) (*azureTypes.AzureInterface, bool) {
+	iface, ok := f[ip.String()]
+	return iface, ok
+}
+
+type AzureFilterTestSuite struct {
+	svc   *Service
+	lbmap *lbmap.LBMockMap
+}
+
+var _ = Suite(&AzureFilterTestSuite{})
+
+func (s *AzureFilterTestSuite) SetUpTest(c *C) {
+	serviceIDAlloc.resetLocalID()
+	backendIDAlloc.resetLocalID()
+
+	s.svc = NewService()
+	s.svc.lbmap = lbmap.NewLBMockMap()
+	s.lbmap = s.svc.lbmap.(*lbmap.LBMockMap)
+}
+
+func (s *AzureFilterTestSuite) TearDownTest(c *C) {
+	serviceIDAlloc.resetLocalID()
+	backendIDAlloc.resetLocalID()
+}
+
+// TestNSGDeniedBackendIsElided asserts that a backend owned by an
+// AzureInterface whose NSG denies the frontend's port is elided from lbmap,
+// while a backend that is allowed is programmed as usual.
+func (s *AzureFilterTestSuite) TestNSGDeniedBackendIsElided(c *C) {
+	allowedIface := &azureTypes.AzureInterface{SecurityGroup: "nsg-allow"}
+	deniedIface := &azureTypes.AzureInterface{SecurityGroup: "nsg-deny"}
+
+	resolver := fakeResolver{
+		"10.0.0.1": allowedIface,
+		"10.0.0.2": deniedIface,
+	}
+
+	evaluator := lbpolicy.NewStaticNSGEvaluator()
+	evaluator.SetRules("nsg-allow", []lbpolicy.Rule{{Protocol: lb.TCP, Port: 80}})
+	// nsg-deny has no rules installed, so it denies every port
+
+	s.svc.SetBackendFilter(&lbpolicy.Filter{
+		Resolver:  resolver,
+		Evaluator: evaluator,
+		Metrics:   &lbpolicy.NoOpMetrics{},
+	})
+
+	frontend := *lb.NewL3n4AddrID(lb.TCP, net.ParseIP("1.1.1.1"), 80, 0)
+	backends := []lb.LBBackEnd{
+		*lb.NewLBBackEnd(0, lb.TCP, net.ParseIP("10.0.0.1"), 8080),
+		*lb.NewLBBackEnd(0, lb.TCP, net.ParseIP("10.0.0.2"), 8080),
+	}
+
+	created, id, err := s.svc.UpsertService(frontend, backends, TypeNodePort)
+	c.Assert(err, IsNil)
+	c.Assert(created, Equals, true)
+
+	// Only the allowed backend should have been programmed into lbmap
+	c.Assert(len(s.lbmap.ServiceBackendsByID[uint16(id)]), Equals, 1)
+	c.Assert(len(s.lbmap.BackendByID), Equals, 1)
+}
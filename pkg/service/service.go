@@ -0,0 +1,309 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+
+	lb "github.com/cilium/cilium/pkg/loadbalancer"
+	lbpolicy "github.com/cilium/cilium/pkg/loadbalancer/policy"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/maps/lbmap"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "service")
+
+// SVCType is the type of a service, e.g. the mechanism used to steer
+// traffic towards its backends
+type SVCType string
+
+const (
+	// TypeNodePort is a service exposed on every node's IP on a static port
+	TypeNodePort SVCType = "NodePort"
+
+	// TypeClusterIP is a service only reachable from inside the cluster
+	TypeClusterIP SVCType = "ClusterIP"
+)
+
+var (
+	serviceIDAlloc = newIDAllocator()
+	backendIDAlloc = newIDAllocator()
+)
+
+// idAllocator hands out local IDs for services and backends. IDs are plain
+// counters scoped to a running agent/operator instance, not anything
+// persisted externally, but they are reused once released since they must
+// fit into the 16-bit keys of the BPF service/backend maps.
+type idAllocator struct {
+	mutex   lock.Mutex
+	nextID  uint32
+	freeIDs []uint32
+}
+
+func newIDAllocator() *idAllocator {
+	return &idAllocator{nextID: 1}
+}
+
+func (a *idAllocator) acquireLocalID() uint32 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if n := len(a.freeIDs); n > 0 {
+		id := a.freeIDs[n-1]
+		a.freeIDs = a.freeIDs[:n-1]
+		return id
+	}
+
+	id := a.nextID
+	a.nextID++
+	return id
+}
+
+// releaseLocalID returns id to the pool so that it can be handed out again
+func (a *idAllocator) releaseLocalID(id uint32) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.freeIDs = append(a.freeIDs, id)
+}
+
+// resetLocalID resets the allocator, only ever used by tests so that
+// assertions on the exact IDs handed out don't depend on test order
+func (a *idAllocator) resetLocalID() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.nextID = 1
+	a.freeIDs = nil
+}
+
+// backend tracks a single load-balancing backend and the number of services
+// currently referencing it, so that a backend shared across multiple
+// services is only removed from lbmap once the last service stops using it
+type backend struct {
+	lb.LBBackEnd
+	refCount int
+}
+
+// svcInfo is the agent-side bookkeeping for a single service
+type svcInfo struct {
+	frontend lb.L3n4AddrID
+	svcType  SVCType
+
+	// backends is keyed by the backend's L3n4Addr string representation
+	backends map[string]lb.BackendID
+}
+
+// Service is the service handler. It maintains in-memory service and
+// backend state and reconciles it into the BPF load-balancing maps.
+type Service struct {
+	mutex lock.RWMutex
+
+	lbmap lbmap.LBMap
+
+	svcByID   map[lb.ID]*svcInfo
+	svcByHash map[string]*svcInfo
+
+	// backendByHash is keyed by the backend's L3n4Addr string
+	// representation and is shared across all services, allowing the
+	// same backend to be referenced by more than one service
+	backendByHash map[string]*backend
+
+	// backendFilter, when set, is consulted before a service's backends
+	// are programmed into lbmap so that backends denied by an Azure NSG
+	// on the frontend's port are elided rather than silently disagreeing
+	// with the cloud firewall
+	backendFilter *lbpolicy.Filter
+}
+
+// NewService creates a new Service handler
+func NewService() *Service {
+	return &Service{
+		lbmap:         lbmap.New(),
+		svcByID:       map[lb.ID]*svcInfo{},
+		svcByHash:     map[string]*svcInfo{},
+		backendByHash: map[string]*backend{},
+	}
+}
+
+// SetBackendFilter installs the NSG-aware backend filter. Passing nil
+// restores the default behavior of programming every backend as-is.
+func (s *Service) SetBackendFilter(filter *lbpolicy.Filter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.backendFilter = filter
+}
+
+// NewAzureService creates a new Service handler with its NSG-aware backend
+// filter already installed, for use on Azure deployments. resolver is
+// typically the azure ipam InstancesManager, which resolves a backend IP to
+// the AzureInterface that owns it.
+func NewAzureService(resolver lbpolicy.BackendMetadataResolver, evaluator lbpolicy.NSGEvaluator, metrics lbpolicy.Metrics) *Service {
+	svc := NewService()
+	svc.SetBackendFilter(&lbpolicy.Filter{
+		Resolver:  resolver,
+		Evaluator: evaluator,
+		Metrics:   metrics,
+	})
+	return svc
+}
+
+// UpsertService inserts or updates the service identified by frontend with
+// the given backends. It returns whether the service was newly created and
+// the ID the service was allocated.
+func (s *Service) UpsertService(frontend lb.L3n4AddrID, backends []lb.LBBackEnd, typ SVCType) (bool, lb.ID, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.backendFilter != nil {
+		allowed, denied := s.backendFilter.Apply(frontend.L3n4Addr, backends)
+		if len(denied) > 0 {
+			log.WithField("serviceID", frontend.ID).
+				WithField("elided", len(denied)).
+				Info("Eliding NSG-denied backends from service")
+		}
+		backends = allowed
+	}
+
+	hash := frontend.L3n4Addr.String()
+	svc, found := s.svcByHash[hash]
+	created := !found
+	if created {
+		id := lb.ID(serviceIDAlloc.acquireLocalID())
+		frontend.ID = id
+		svc = &svcInfo{
+			frontend: frontend,
+			svcType:  typ,
+			backends: map[string]lb.BackendID{},
+		}
+		s.svcByHash[hash] = svc
+		s.svcByID[id] = svc
+	}
+
+	wanted := map[string]lb.LBBackEnd{}
+	for _, be := range backends {
+		wanted[be.L3n4Addr.String()] = be
+	}
+
+	// Remove backends that are no longer wanted
+	for beHash, beID := range svc.backends {
+		if _, ok := wanted[beHash]; ok {
+			continue
+		}
+		if err := s.releaseBackend(beHash, beID); err != nil {
+			return created, svc.frontend.ID, err
+		}
+		delete(svc.backends, beHash)
+	}
+
+	// Add backends that are new to this service
+	for beHash, be := range wanted {
+		if _, ok := svc.backends[beHash]; ok {
+			continue
+		}
+		beID, err := s.acquireBackend(be)
+		if err != nil {
+			return created, svc.frontend.ID, err
+		}
+		svc.backends[beHash] = beID
+	}
+
+	backendIDs := make([]lb.BackendID, 0, len(svc.backends))
+	for _, beID := range svc.backends {
+		backendIDs = append(backendIDs, beID)
+	}
+
+	if err := s.lbmap.UpsertService(svc.frontend.ID, svc.frontend.L3n4Addr, backendIDs); err != nil {
+		return created, svc.frontend.ID, fmt.Errorf("unable to upsert service %s into lbmap: %w", hash, err)
+	}
+
+	return created, svc.frontend.ID, nil
+}
+
+// DeleteServiceByID removes the service identified by id, releasing all of
+// its backends that are not referenced by any other service. It returns
+// whether the service was found.
+func (s *Service) DeleteServiceByID(id lb.ServiceID) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	svc, ok := s.svcByID[lb.ID(id)]
+	if !ok {
+		return false, nil
+	}
+
+	for beHash, beID := range svc.backends {
+		if err := s.releaseBackend(beHash, beID); err != nil {
+			return true, err
+		}
+		delete(svc.backends, beHash)
+	}
+
+	if err := s.lbmap.DeleteService(svc.frontend.ID); err != nil {
+		return true, fmt.Errorf("unable to delete service %s from lbmap: %w", svc.frontend.L3n4Addr.String(), err)
+	}
+
+	delete(s.svcByID, svc.frontend.ID)
+	delete(s.svcByHash, svc.frontend.L3n4Addr.String())
+	serviceIDAlloc.releaseLocalID(uint32(svc.frontend.ID))
+
+	return true, nil
+}
+
+// acquireBackend returns the ID of the backend identified by be, allocating
+// a new one and programming it into lbmap if this is its first reference
+func (s *Service) acquireBackend(be lb.LBBackEnd) (lb.BackendID, error) {
+	hash := be.L3n4Addr.String()
+
+	if existing, ok := s.backendByHash[hash]; ok {
+		existing.refCount++
+		return existing.ID, nil
+	}
+
+	be.ID = lb.BackendID(backendIDAlloc.acquireLocalID())
+	if err := s.lbmap.AddBackend(be); err != nil {
+		return 0, fmt.Errorf("unable to add backend %s to lbmap: %w", hash, err)
+	}
+
+	s.backendByHash[hash] = &backend{LBBackEnd: be, refCount: 1}
+
+	return be.ID, nil
+}
+
+// releaseBackend drops a reference to the backend identified by beHash/beID,
+// removing it from lbmap once the last reference is gone
+func (s *Service) releaseBackend(beHash string, beID lb.BackendID) error {
+	b, ok := s.backendByHash[beHash]
+	if !ok {
+		return nil
+	}
+
+	b.refCount--
+	if b.refCount > 0 {
+		return nil
+	}
+
+	if err := s.lbmap.DeleteBackend(beID); err != nil {
+		return fmt.Errorf("unable to delete backend %s from lbmap: %w", beHash, err)
+	}
+
+	delete(s.backendByHash, beHash)
+	backendIDAlloc.releaseLocalID(uint32(beID))
+
+	return nil
+}